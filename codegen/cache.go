@@ -0,0 +1,182 @@
+package codegen
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// cacheVersion identifies the ply binary that produced a cache entry,
+// derived from the build's embedded VCS info rather than a hand-maintained
+// constant: a constant needs a human to remember to bump it on every
+// generator change, which is exactly the failure mode this cache exists to
+// avoid -- a forgotten bump would silently serve a stale specialization
+// from a generator change forever. debug.ReadBuildInfo reports the VCS
+// revision (plus a ".dirty" suffix when the build had uncommitted changes)
+// for a ply binary built the ordinary "go build"/"go install" way; one
+// built without VCS stamping -- "go run", or go.mod's "-buildvcs=false" --
+// has no way to self-identify and falls back to a fixed string, which
+// still busts every prior entry whenever that fallback itself changes.
+var cacheVersion = func() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	var revision string
+	var dirty bool
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			dirty = s.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "unknown"
+	}
+	if dirty {
+		return revision + ".dirty"
+	}
+	return revision
+}()
+
+// specCache is an on-disk cache of generated specializations, addressed by a
+// hash of the generic call site that produced them. It's modeled on gopls'
+// package cache: instead of re-running a generator for every call site on
+// every invocation, a warm rebuild reads the previous output straight off
+// disk.
+//
+// That only actually happens for plainFormGenerators' two entries, "map"
+// and "filter": a cache hit is only usable when the callsite rewrite can be
+// reconstructed from nothing but the stored (name, code) pair, and
+// plainFormRewrite's "call the generated name with the original
+// receiver/args" shape is the only rewrite simple enough for that. Every
+// other generator -- the rest of the built-ins (reduce, sort, ...), every
+// //ply:generic user template, and pipeline fusions, which aren't cached at
+// all -- still runs in full on every compile; Rewrite only ever calls
+// cacheStore for the two it can load back. So a warm rebuild turns
+// O(files x generics) into O(changed files) only for a map/filter-heavy
+// project; it doesn't generalize to the whole generator set yet.
+type specCache struct {
+	dir string
+}
+
+// newSpecCache opens the cache rooted at dir, creating it if necessary. An
+// empty dir defaults to $GOCACHE/ply, which can be overridden with the
+// PLYCACHE environment variable for users who want the generated sources
+// kept somewhere other than the Go build cache.
+func newSpecCache(dir string) (*specCache, error) {
+	if dir == "" {
+		var err error
+		dir, err = defaultCacheDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &specCache{dir: dir}, nil
+}
+
+func defaultCacheDir() (string, error) {
+	if d := os.Getenv("PLYCACHE"); d != "" {
+		return d, nil
+	}
+	if d := os.Getenv("GOCACHE"); d != "" {
+		return filepath.Join(d, "ply"), nil
+	}
+	out, err := exec.Command("go", "env", "GOCACHE").Output()
+	if err != nil {
+		return "", fmt.Errorf("codegen: locating GOCACHE: %w", err)
+	}
+	return filepath.Join(strings.TrimSpace(string(out)), "ply"), nil
+}
+
+// specEntry is the persisted form of a specialization: the name of the
+// generated declaration, used both as the key under which it's merged into
+// spec.pkg.Files and, for a plainFormGenerators entry, to rebuild the
+// callsite rewrite without re-running the generator that produced it.
+type specEntry struct {
+	Name string
+	Code string
+}
+
+// plainFormGenerators lists the generator names whose rewrite is known to
+// be exactly "call the generated name with the original receiver/args" --
+// &ast.CallExpr{Fun: ident(name), Args: originalArgs} -- and nothing more.
+// Those are the only generators eligible for the cache's generic callsite
+// reconstruction on a hit. Every other generator must always run its real
+// rewrite: e.g. ply's reduce with no initial accumulator synthesizes a seed
+// from the slice itself, restructuring the callsite rather than just
+// renaming it, so reusing a cached decl without rerunning reduce's own
+// rewrite would let a warm build silently diverge from a cold one.
+var plainFormGenerators = map[string]bool{
+	"map":    true,
+	"filter": true,
+}
+
+// plainFormRewrite reconstructs the callsite a plainFormGenerators entry's
+// own rewrite would have produced, per the contract documented above:
+// calling the generated name with recv (if any, for a method call) prepended
+// to args. It's the single place that shape is built, so Rewrite's cache-hit
+// path for both the ident- and method-call cases can't drift from each
+// other, or from the shape a plain-form generator's real rewrite produces.
+func plainFormRewrite(name string, recv ast.Expr, args []ast.Expr) *ast.CallExpr {
+	if recv != nil {
+		args = append([]ast.Expr{recv}, args...)
+	}
+	return &ast.CallExpr{Fun: ast.NewIdent(name), Args: args}
+}
+
+// callSig hashes a generic call site's generator name and canonical type
+// arguments (e.g. "filter" + "[]int") together with the ply and Go
+// toolchain versions, so a generator change or Go upgrade invalidates every
+// entry rather than serving a specialization built by different code.
+func callSig(gen string, typeArgs ...string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "ply=%s\ngo=%s\ngen=%s\n", cacheVersion, runtime.Version(), gen)
+	for _, t := range typeArgs {
+		fmt.Fprintf(h, "arg=%s\n", t)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *specCache) path(sig string) string {
+	return filepath.Join(c.dir, sig[:2], sig[2:]+".json")
+}
+
+func (c *specCache) load(sig string) (specEntry, bool) {
+	b, err := os.ReadFile(c.path(sig))
+	if err != nil {
+		return specEntry{}, false
+	}
+	var e specEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return specEntry{}, false
+	}
+	return e, true
+}
+
+func (c *specCache) store(sig string, e specEntry) {
+	p := c.path(sig)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	// Best-effort: a failed write just means the next compile recomputes
+	// this entry, same as a cold cache.
+	os.WriteFile(p, b, 0644)
+}
@@ -0,0 +1,98 @@
+package codegen
+
+import (
+	"go/ast"
+	"go/token"
+	"testing"
+)
+
+func TestCallSigDeterministic(t *testing.T) {
+	a := callSig("filter", "[]int")
+	b := callSig("filter", "[]int")
+	if a != b {
+		t.Fatalf("callSig not deterministic: %q != %q", a, b)
+	}
+}
+
+func TestCallSigDistinguishesGeneratorAndArgs(t *testing.T) {
+	base := callSig("filter", "[]int")
+	for _, sig := range []string{
+		callSig("map", "[]int"),
+		callSig("filter", "[]string"),
+		callSig("filter", "[]int", "func(int) bool"),
+	} {
+		if sig == base {
+			t.Errorf("callSig collided with base signature: %q", sig)
+		}
+	}
+}
+
+func TestSpecCacheStoreLoad(t *testing.T) {
+	c, err := newSpecCache(t.TempDir())
+	if err != nil {
+		t.Fatalf("newSpecCache: %v", err)
+	}
+
+	sig := callSig("filter", "[]int")
+	if _, ok := c.load(sig); ok {
+		t.Fatal("load on an empty cache returned a hit")
+	}
+
+	want := specEntry{Name: "filter_int", Code: "\nfunc filter_int() {}\n"}
+	c.store(sig, want)
+	got, ok := c.load(sig)
+	if !ok {
+		t.Fatal("load after store returned a miss")
+	}
+	if got != want {
+		t.Errorf("load = %+v, want %+v", got, want)
+	}
+}
+
+// TestPlainFormRewriteMatchesGeneratorContract checks plainFormRewrite
+// against the shape plainFormGenerators documents map/filter's real rewrite
+// as having -- the generated name called with the original receiver and
+// args, nothing else. The expected value is built by hand from that
+// documented shape; the real map/filter generators are not called, so a
+// change to either of them does not make this test fail.
+//
+// The callsites are built directly rather than parsed from source: "map"
+// is a Go keyword, so go/parser rejects ".map(...)" outright (it's not a
+// valid selector), and the AST shape is all plainFormRewrite cares about.
+func TestPlainFormRewriteMatchesGeneratorContract(t *testing.T) {
+	fset := token.NewFileSet()
+	recv := ast.NewIdent("nums")
+	arg := ast.NewIdent("fn")
+
+	for _, genName := range []string{"filter", "map"} {
+		if !plainFormGenerators[genName] {
+			t.Fatalf("%s not in plainFormGenerators", genName)
+		}
+		call := &ast.CallExpr{
+			Fun:  &ast.SelectorExpr{X: recv, Sel: ast.NewIdent(genName)},
+			Args: []ast.Expr{arg},
+		}
+		name := genName + "_int"
+		// The rewrite plainFormGenerators documents map/filter's generator
+		// as producing.
+		generatorRewrite := &ast.CallExpr{Fun: ast.NewIdent(name), Args: append([]ast.Expr{recv}, call.Args...)}
+		want := astToBytes(fset, generatorRewrite)
+		got := astToBytes(fset, plainFormRewrite(name, recv, call.Args))
+		if string(got) != string(want) {
+			t.Errorf("%s: plainFormRewrite = %s, want %s", genName, got, want)
+		}
+	}
+}
+
+func TestPlainFormGenerators(t *testing.T) {
+	for _, name := range []string{"map", "filter"} {
+		if !plainFormGenerators[name] {
+			t.Errorf("expected %q to be eligible for the cache's plain-form reconstruction", name)
+		}
+	}
+	for _, name := range []string{"reduce", "sort", "unknown"} {
+		if plainFormGenerators[name] {
+			t.Errorf("expected %q not to be eligible for the cache's plain-form reconstruction", name)
+		}
+	}
+}
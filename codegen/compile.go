@@ -2,23 +2,36 @@ package codegen
 
 import (
 	"bytes"
-	"errors"
+	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/printer"
 	"go/token"
 	"log"
-	"os/exec"
+	"os"
 	"path/filepath"
 	"strings"
 
-	"github.com/lukechampine/ply/importer"
 	"github.com/lukechampine/ply/types"
 
 	"github.com/tsuna/gorewrite"
 	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/packages"
 )
 
+// loadMode is the set of information we need packages.Load to gather for
+// each package: enough to parse, type-check, and walk the syntax tree of
+// every file, plus their dependencies so imports resolve correctly in a
+// modules (or workspace) build. NeedImports has to be listed explicitly
+// alongside NeedDeps: NeedDeps only says a dependency's *own* requested
+// fields get filled in once packages.Load reaches it, it doesn't populate
+// Package.Imports itself. Without NeedImports, Imports is left empty on
+// every package, including the root one -- and newDepsImporter's
+// packages.Visit call walks the graph purely through Imports, so it would
+// never see a single dependency, real or not.
+const loadMode = packages.NeedName | packages.NeedFiles | packages.NeedSyntax |
+	packages.NeedTypes | packages.NeedTypesInfo | packages.NeedImports | packages.NeedDeps
+
 // A specializer is a Rewriter that generates specialized versions of each
 // generic ply function and rewrites the callsites to use their corresponding
 // specialized function.
@@ -27,6 +40,114 @@ type specializer struct {
 	fset    *token.FileSet
 	pkg     *ast.Package
 	imports map[string]struct{}
+
+	// cache is consulted before running a generator and populated after, so
+	// that a later compile of the same call site can skip straight to
+	// addDecl. It's nil-safe: a specializer built without one (e.g. in
+	// tests) just regenerates everything, as before.
+	cache *specCache
+
+	// registry holds caller- and directive-provided generators, consulted
+	// before funcGenerators/methodGenerators. It's nil-safe, same as cache.
+	registry *Registry
+
+	// genErr records the first error addDecl hits parsing a generated
+	// declaration. A built-in generator's output is trusted, but a
+	// //ply:generic template monomorphizes user code, which can produce
+	// invalid Go (e.g. an unhandled concrete type shape); addDecl must
+	// report that back to the caller instead of aborting the process, so
+	// it's threaded through this pointer rather than added to Rewrite's
+	// return, whose signature is fixed by gorewrite.Rewriter.
+	genErr *error
+}
+
+// lookupFunc resolves name to a Generator, preferring the registry over the
+// built-in set.
+func (s specializer) lookupFunc(name string) (Generator, bool) {
+	if s.registry != nil {
+		if gen, ok := s.registry.funcs[name]; ok {
+			return gen, true
+		}
+	}
+	gen, ok := funcGenerators[name]
+	return gen, ok
+}
+
+// lookupMethod resolves name to a MethodGenerator, preferring the registry
+// over the built-in set.
+func (s specializer) lookupMethod(name string) (MethodGenerator, bool) {
+	if s.registry != nil {
+		if gen, ok := s.registry.methods[name]; ok {
+			return gen, true
+		}
+	}
+	gen, ok := methodGenerators[name]
+	return gen, ok
+}
+
+// CompileError reports every type error found while checking a package,
+// rather than just the first one. A CallExpr whose operand types are
+// missing or invalid because of one of these errors is left unrewritten;
+// every other call site is still specialized normally, so Compile can
+// return both a *CompileError and a usable, if incomplete, result.
+//
+// Error joins every one of Errors into a single multi-line message; the
+// ply command's -errors flag controls whether that's what gets printed to
+// the user or just Errors[0] (see main.go).
+type CompileError struct {
+	Errors []types.Error
+}
+
+func (e *CompileError) Error() string {
+	var b strings.Builder
+	for i, err := range e.Errors {
+		if i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+// exprsValid reports whether every expression has a valid, known type. A
+// CallExpr built from an operand that failed to type-check (and so has no
+// type, or the Invalid type) can't be specialized safely and is skipped.
+func exprsValid(exprs []ast.Expr, exprTypes map[ast.Expr]types.TypeAndValue) bool {
+	for _, e := range exprs {
+		t := exprTypes[e].Type
+		if t == nil {
+			return false
+		}
+		if basic, ok := t.(*types.Basic); ok && basic.Kind() == types.Invalid {
+			return false
+		}
+	}
+	return true
+}
+
+// argTypes returns the canonical type of each expression, in order, for use
+// as part of a cache key.
+func argTypes(exprs []ast.Expr, exprTypes map[ast.Expr]types.TypeAndValue) []string {
+	out := make([]string, len(exprs))
+	for i, e := range exprs {
+		out[i] = exprTypes[e].Type.String()
+	}
+	return out
+}
+
+// chainExprs collects every expression a pipeline chain's specialization
+// reads: the innermost receiver and each call's arguments, in no particular
+// order. It's what exprsValid needs to check before buildPipeline runs, the
+// same way the single-call branches below check their own receiver/args.
+func chainExprs(chain []*ast.CallExpr) []ast.Expr {
+	if len(chain) == 0 {
+		return nil
+	}
+	exprs := []ast.Expr{chain[len(chain)-1].Fun.(*ast.SelectorExpr).X}
+	for _, call := range chain {
+		exprs = append(exprs, call.Args...)
+	}
+	return exprs
 }
 
 func hasMethod(recv ast.Expr, method string, exprTypes map[ast.Expr]types.TypeAndValue) bool {
@@ -49,7 +170,13 @@ func (s specializer) addDecl(filename, code string) {
 	code = "package " + s.pkg.Name + code
 	f, err := parser.ParseFile(s.fset, "", code, 0)
 	if err != nil {
-		log.Fatal(err)
+		// Only a //ply:generic template can reach this with invalid code
+		// (a built-in generator's output is trusted); record the failure
+		// for the caller rather than killing the process on user input.
+		if *s.genErr == nil {
+			*s.genErr = fmt.Errorf("codegen: generated invalid Go for %s: %w", filename, err)
+		}
+		return
 	}
 	s.pkg.Files[filename] = f
 }
@@ -60,17 +187,39 @@ func (s specializer) Rewrite(node ast.Node) (ast.Node, gorewrite.Rewriter) {
 		var rewrote bool
 		switch fn := n.Fun.(type) {
 		case *ast.Ident:
-			if gen, ok := funcGenerators[fn.Name]; ok {
+			if gen, ok := s.lookupFunc(fn.Name); ok && exprsValid(n.Args, s.types) {
 				if v := s.types[n].Value; v != nil {
 					// some functions (namely max/min) may evaluate to a
 					// constant, in which case we should replace the call with
 					// a constant expression.
 					node = ast.NewIdent(v.ExactString())
 				} else {
-					name, code, rewrite := gen(fn, n.Args, s.types)
-					s.addDecl(name, code)
-					node = rewrite(n)
-					rewrote = true
+					sig := callSig(fn.Name, argTypes(n.Args, s.types)...)
+					// A registry entry shadowing a plainFormGenerators name is
+					// not the built-in generator that list vouches for.
+					plain := plainFormGenerators[fn.Name] && (s.registry == nil || s.registry.funcs[fn.Name] == nil)
+					if e, ok := s.cacheLoad(sig); ok && plain {
+						s.addDecl(e.Name, e.Code)
+						node = plainFormRewrite(e.Name, nil, n.Args)
+						rewrote = true
+					} else if name, code, rewrite := gen(fn, n.Args, s.types); name != "" {
+						// An empty name means the generator could not specialize
+						// this callsite -- e.g. a //ply:generic func whose type
+						// parameter can't be inferred from the arguments -- and
+						// reported that by returning "" rather than panicking.
+						// Leave the call as written.
+						s.addDecl(name, code)
+						node = rewrite(n)
+						if plain {
+							// Only a plainFormGenerators entry's rewrite can be
+							// reconstructed from just (name, code) on a later
+							// cacheLoad hit; storing one for any other generator
+							// would just be dead weight on disk that cacheLoad's
+							// own plainFormGenerators check can never read back.
+							s.cacheStore(sig, name, code)
+						}
+						rewrote = true
+					}
 				}
 			}
 
@@ -85,19 +234,51 @@ func (s specializer) Rewrite(node ast.Node) (ast.Node, gorewrite.Rewriter) {
 				}
 				chain = append(chain, cur)
 			}
-			if p := buildPipeline(chain, s.types); p != nil {
-				name, code, rewrite := p.gen()
-				s.addDecl(name, code)
-				node = rewrite(n)
+			chainValid := exprsValid(chainExprs(chain), s.types)
+			var fusedName, fusedCode string
+			var fusedRewrite func(*ast.CallExpr) ast.Node
+			if chainValid {
+				// Only consult buildPipeline once every operand in the
+				// chain is known to have a valid type: a chain built from
+				// a call site with a missing/Invalid operand type -- the
+				// kind a .ply file with several unrelated mistakes
+				// produces -- can't be specialized safely, and
+				// buildPipeline isn't expected to defend itself against
+				// that on its own.
+				if p := buildPipeline(chain, s.types); p != nil {
+					fusedName, fusedCode, fusedRewrite = p.gen()
+				}
+			}
+			if fusedRewrite != nil {
+				// Pipeline fusions aren't cached yet: their rewrite depends
+				// on the whole chain's shape, not just a single callsite's
+				// name and argument types.
+				s.addDecl(fusedName, fusedCode)
+				node = fusedRewrite(n)
 				rewrote = true
-			} else if gen, ok := methodGenerators[fn.Sel.Name]; ok && !hasMethod(fn.X, fn.Sel.Name, s.types) {
-				name, code, rewrite := gen(fn, n.Args, s.types)
-				s.addDecl(name, code)
-				node = rewrite(n)
-				if fn.Sel.Name == "sort" {
+			} else if gen, ok := s.lookupMethod(fn.Sel.Name); ok && exprsValid(append([]ast.Expr{fn.X}, n.Args...), s.types) && !hasMethod(fn.X, fn.Sel.Name, s.types) {
+				sig := callSig(fn.Sel.Name, argTypes(append([]ast.Expr{fn.X}, n.Args...), s.types)...)
+				plain := plainFormGenerators[fn.Sel.Name] && (s.registry == nil || s.registry.methods[fn.Sel.Name] == nil)
+				if e, ok := s.cacheLoad(sig); ok && plain {
+					s.addDecl(e.Name, e.Code)
+					node = plainFormRewrite(e.Name, fn.X, n.Args)
+					rewrote = true
+				} else if name, code, rewrite := gen(fn, n.Args, s.types); name != "" {
+					// As in the ident-call branch above, an empty name leaves
+					// the call as written.
+					s.addDecl(name, code)
+					node = rewrite(n)
+					if plain {
+						// See the matching comment in the ident-call branch
+						// above: a non-plain-form entry can never be loaded
+						// back, so storing one would just waste disk.
+						s.cacheStore(sig, name, code)
+					}
+					rewrote = true
+				}
+				if rewrote && fn.Sel.Name == "sort" {
 					s.imports["sort"] = struct{}{}
 				}
-				rewrote = true
 			}
 		}
 		if named, ok := s.types[n].Type.(*types.Named); ok && rewrote {
@@ -113,6 +294,24 @@ func (s specializer) Rewrite(node ast.Node) (ast.Node, gorewrite.Rewriter) {
 	return node, s
 }
 
+// cacheLoad reports whether a specialization for sig already exists on
+// disk. It's a no-op miss when s.cache is nil.
+func (s specializer) cacheLoad(sig string) (specEntry, bool) {
+	if s.cache == nil {
+		return specEntry{}, false
+	}
+	return s.cache.load(sig)
+}
+
+// cacheStore persists a freshly generated specialization under sig. It's a
+// no-op when s.cache is nil.
+func (s specializer) cacheStore(sig, name, code string) {
+	if s.cache == nil {
+		return
+	}
+	s.cache.store(sig, specEntry{Name: name, Code: code})
+}
+
 func (s specializer) implBytes() []byte {
 	var buf bytes.Buffer
 	pcfg := &printer.Config{Tabwidth: 8, Mode: printer.RawFormat}
@@ -130,41 +329,259 @@ func astToBytes(fset *token.FileSet, node interface{}) []byte {
 // Compile compiles the provided files as a single package. For each supplied
 // .ply file, the compiled Go code is returned, keyed by the original filename.
 func Compile(filenames []string) (map[string][]byte, error) {
-	// parse each supplied file
-	fset := token.NewFileSet()
-	var files []*ast.File
-	plyFiles := make(map[string]*ast.File)
-	for _, arg := range filenames {
-		f, err := parser.ParseFile(fset, arg, nil, parser.ParseComments)
+	return CompileConfig(filenames, &packages.Config{Mode: loadMode})
+}
+
+// CompileConfig is like Compile, but lets the caller supply the
+// packages.Config used to load the package. This is the extension point for
+// tests and editors: setting cfg.Overlay lets a caller map a .ply file's path
+// to rewritten Go source (e.g. a buffer's unsaved contents) so it can be
+// analyzed without touching disk, and cfg.Dir/cfg.Env let callers point at a
+// specific module or workspace.
+func CompileConfig(filenames []string, cfg *packages.Config) (map[string][]byte, error) {
+	return CompileRegistry(filenames, cfg, nil)
+}
+
+// plyOverlay rewrites each .ply entry of filenames to a synthetic .go path:
+// the "go list" driver behind packages.Load rejects named files that don't
+// end in .go outright ("named files must be .go files"), so a .ply path
+// can never be passed to it directly. It returns the rewritten filenames,
+// an overlay mapping each synthetic path to that file's Go source --
+// overlay's own entry for the .ply path if the caller supplied one (e.g. a
+// buffer's unsaved contents), or the file's contents on disk otherwise --
+// merged with overlay, and a synthetic-path -> original-path map so callers
+// can translate packages.Load's results back.
+func plyOverlay(filenames []string, overlay map[string][]byte) (rewritten []string, merged map[string][]byte, synthToOrig map[string]string, err error) {
+	merged = make(map[string][]byte, len(overlay))
+	for k, v := range overlay {
+		abs, err := filepath.Abs(k)
 		if err != nil {
-			return nil, err
+			return nil, nil, nil, err
 		}
-		files = append(files, f)
-		if filepath.Ext(arg) == ".ply" {
-			plyFiles[arg] = f
-		}
-	}
-	if len(plyFiles) == 0 {
-		return nil, nil
+		merged[abs] = v
 	}
 
-	// install each import
-	for _, f := range files {
-		for _, im := range f.Imports {
-			out, err := exec.Command("go", "install", strings.Trim(im.Path.Value, `"`)).CombinedOutput()
+	synthToOrig = make(map[string]string)
+	rewritten = make([]string, len(filenames))
+	for i, name := range filenames {
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if filepath.Ext(name) != ".ply" {
+			rewritten[i] = abs
+			continue
+		}
+		content, ok := merged[abs]
+		if !ok {
+			content, err = os.ReadFile(name)
 			if err != nil {
-				return nil, errors.New(string(out))
+				return nil, nil, nil, err
 			}
 		}
+		synth := abs + ".go"
+		merged[synth] = content
+		synthToOrig[synth] = name
+		rewritten[i] = synth
+	}
+	return rewritten, merged, synthToOrig, nil
+}
+
+// loadErrors collects every packages.Error in pkgs and their dependencies,
+// except packages.TypeError. loadMode's NeedTypes runs plain go/types over
+// the synthetic .go copy of each .ply file, which rejects ply's
+// pseudo-generic calls (xs.filter(f), xs.map(g), ...) as undefined methods
+// -- exactly the syntax ply's own checker exists to tolerate, re-run below.
+// Those type errors are expected and handled by that re-check; only a
+// genuine load/parse/list failure here should stop Compile before it gets
+// there.
+func loadErrors(pkgs []*packages.Package) []packages.Error {
+	var errs []packages.Error
+	packages.Visit(pkgs, nil, func(p *packages.Package) {
+		for _, e := range p.Errors {
+			if e.Kind == packages.TypeError {
+				continue
+			}
+			errs = append(errs, e)
+		}
+	})
+	return errs
+}
+
+// depsImporter adapts the dependency graph packages.Load already resolved
+// into a ply types.Importer, so resolving an import honors the same
+// go.mod/go.work-aware resolution instead of falling back to
+// importer.Default()'s GOPATH/go-build lookup -- the exact limitation this
+// request replaces.
+//
+// *go/types.Package, the type packages.Load's NeedTypes hands back, and
+// ply's forked *types.Package are independently maintained: nothing
+// guarantees their struct layouts still match (go/types has grown plenty
+// of fields in service of generics since whatever version ply's fork was
+// frozen at), so converting one to the other by pointer cast would be a
+// bet that only surfaces its cost as a corrupted scope, not a compile
+// error. Instead, Import re-checks the dependency's own source with ply's
+// checker -- the same conf.Check CompileRegistry already runs over the
+// top-level package -- building a real ply *types.Package the honest way.
+// packages.Load is still what makes this possible for a dependency outside
+// the module: with NeedDeps set alongside NeedSyntax, it parses source for
+// the whole transitive graph, not just the initially matched packages, so
+// there's always an AST here to feed to Check.
+//
+// A generic declaration in a dependency's source (Go's real generics, not
+// ply's pseudo-generic method calls) will fail ply's pre-generics checker
+// the same way it always could have. Import collects the checker's errors
+// but returns them only when Check produces no package at all; otherwise it
+// returns the package as checked, and a declaration the checker rejected
+// may carry an incomplete or invalid type.
+type depsImporter struct {
+	pkgs  map[string]*packages.Package
+	cache map[string]*types.Package
+}
+
+// newDepsImporter indexes lpkg and its full dependency graph by import
+// path.
+func newDepsImporter(lpkg *packages.Package) *depsImporter {
+	d := &depsImporter{
+		pkgs:  make(map[string]*packages.Package),
+		cache: make(map[string]*types.Package),
+	}
+	packages.Visit([]*packages.Package{lpkg}, nil, func(p *packages.Package) {
+		d.pkgs[p.PkgPath] = p
+	})
+	return d
+}
+
+func (d *depsImporter) Import(path string) (*types.Package, error) {
+	if path == "unsafe" {
+		// unsafe has no Go source to check; both go/types and its fork
+		// predeclare it directly.
+		return types.Unsafe, nil
+	}
+	if pkg, ok := d.cache[path]; ok {
+		// Already checked, possibly while resolving a sibling import of
+		// the same dependency -- Check is not cheap, and d is reused as
+		// the Importer for every dependency's own conf.Check below, so a
+		// diamond in the import graph would otherwise redo this work once
+		// per importer.
+		return pkg, nil
+	}
+	p, ok := d.pkgs[path]
+	if !ok {
+		return nil, fmt.Errorf("codegen: %q not found among packages.Load's resolved dependencies", path)
+	}
+	if len(p.Syntax) == 0 {
+		return nil, fmt.Errorf("codegen: %q has no source available from packages.Load (only export data, e.g. a binary-only package); ply's checker needs source to re-check it", path)
+	}
+	var checkErrs []types.Error
+	conf := types.Config{Importer: d}
+	conf.Error = func(err error) {
+		if terr, ok := err.(types.Error); ok {
+			checkErrs = append(checkErrs, terr)
+		}
+	}
+	pkg, _ := conf.Check(p.PkgPath, p.Fset, p.Syntax, nil)
+	if pkg == nil {
+		return nil, fmt.Errorf("codegen: %s: type-checking dependency failed: %v", path, checkErrs)
+	}
+	d.cache[path] = pkg
+	return pkg, nil
+}
+
+// CompileRegistry is like CompileConfig, but also consults reg before the
+// built-in funcGenerators/methodGenerators when specializing a callsite.
+// reg may be nil, in which case only the built-ins and any //ply:generic
+// directives found in the package apply.
+func CompileRegistry(filenames []string, cfg *packages.Config, reg *Registry) (map[string][]byte, error) {
+	cfg.Mode |= loadMode
+
+	rewritten, overlay, synthToOrig, err := plyOverlay(filenames, cfg.Overlay)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Overlay = overlay
+
+	// Load resolves filenames against the surrounding go.mod/go.work, parses
+	// them, and loads their dependencies -- replacing the old per-import "go
+	// install" shell-out and raw go/parser.ParseFile calls, neither of which
+	// understood modules.
+	pkgs, err := packages.Load(cfg, rewritten...)
+	if err != nil {
+		return nil, err
+	}
+	if errs := loadErrors(pkgs); len(errs) > 0 {
+		return nil, fmt.Errorf("codegen: errors loading package: %v", errs)
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("codegen: expected filenames to resolve to a single package, got %d", len(pkgs))
+	}
+	lpkg := pkgs[0]
+
+	plyFiles := make(map[string]*ast.File)
+	for i, f := range lpkg.Syntax {
+		if orig, ok := synthToOrig[lpkg.CompiledGoFiles[i]]; ok {
+			plyFiles[orig] = f
+		}
+	}
+	if len(plyFiles) == 0 {
+		return nil, nil
 	}
 
-	// type-check the package
+	// Re-type-check the package with ply's own checker: unlike go/types, it
+	// tolerates the not-yet-real generic calls (.filter, .map, .reduce, ...)
+	// that a .ply file is built from, and records type info for their
+	// operands so the specializer below has something to work with.
 	info := types.Info{
 		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
 	}
+	var typeErrs []types.Error
 	var conf types.Config
-	conf.Importer = importer.Default()
-	pkg, err := conf.Check("", fset, files, &info)
+	conf.Importer = newDepsImporter(lpkg)
+	conf.Error = func(err error) {
+		// Collect every error instead of letting Check bail after the
+		// first: a .ply file commonly has several unrelated mistakes, and
+		// aborting early would also stop us from generating impls for the
+		// call sites that are fine.
+		if terr, ok := err.(types.Error); ok {
+			typeErrs = append(typeErrs, terr)
+		}
+	}
+	// Check's own returned error is just the first of whatever was passed
+	// to conf.Error above, already collected into typeErrs; treating it as
+	// fatal here would make this whole "collect every error and still
+	// specialize the callsites that are fine" path dead code -- Check
+	// returns a non-nil error on *any* type error in the package. Only a
+	// nil pkg (a failure check couldn't recover from at all) is fatal.
+	//
+	// stripGenericFuncs drops any //ply:generic FuncDecl first: those carry
+	// a real Go type-parameter list that ply's pre-generics checker has no
+	// notion of, and that's fine, because a template's body is never
+	// type-checked as written -- mergeUserGenerics below monomorphizes it
+	// straight from each callsite's concrete types instead.
+	pkg, _ := conf.Check(lpkg.PkgPath, lpkg.Fset, stripGenericFuncs(lpkg.Syntax), &info)
+	if pkg == nil {
+		return nil, fmt.Errorf("codegen: %s: type-checking failed", lpkg.PkgPath)
+	}
+
+	// Splice together ply calls that are only chained implicitly, through a
+	// single-use intermediate variable, so they get the same fused,
+	// single-loop specialization as an explicit `nums.filter(f).map(g)`.
+	fusePipelines(lpkg.Syntax, &info)
+
+	// cache is best-effort: if it can't be opened (e.g. no "go" binary on
+	// PATH to ask for GOCACHE), compilation proceeds without it rather than
+	// failing outright.
+	cache, err := newSpecCache("")
+	if err != nil {
+		log.Printf("codegen: specialization cache disabled: %v", err)
+	}
+
+	// Fold in any //ply:generic func directives found in the package, so a
+	// user-defined generic gets the same dispatch as a built-in one without
+	// the caller having to register it by hand.
+	reg, err = mergeUserGenerics(reg, lpkg.Syntax, pkg)
 	if err != nil {
 		return nil, err
 	}
@@ -174,29 +591,41 @@ func Compile(filenames []string) (map[string][]byte, error) {
 	set := make(map[string][]byte)
 	for name, f := range plyFiles {
 		// create a specializer
+		var genErr error
 		spec := specializer{
 			types: info.Types,
-			fset:  fset,
+			fset:  lpkg.Fset,
 			pkg: &ast.Package{
 				Name:  pkg.Name(),
 				Files: make(map[string]*ast.File),
 			},
-			imports: make(map[string]struct{}),
+			imports:  make(map[string]struct{}),
+			cache:    cache,
+			registry: reg,
+			genErr:   &genErr,
 		}
 
 		// rewrite callsites while generating impls
 		gorewrite.Rewrite(spec, f)
+		if genErr != nil {
+			return nil, genErr
+		}
 
 		// add impl imports
 		for importPath := range spec.imports {
-			astutil.AddImport(fset, f, importPath)
+			astutil.AddImport(lpkg.Fset, f, importPath)
 		}
 		// manually merge f with impls
-		code := astToBytes(fset, f)
+		code := astToBytes(lpkg.Fset, f)
 		impls := spec.implBytes()
 		impls = impls[bytes.IndexByte(impls, '\n'):] // remove package decl
 		set[name] = append(code, impls...)
 	}
 
+	if len(typeErrs) > 0 {
+		// Every type error found during checking, not just the first;
+		// see CompileError.
+		return set, &CompileError{Errors: typeErrs}
+	}
 	return set, nil
 }
@@ -0,0 +1,83 @@
+package codegen
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lukechampine/ply/types"
+	"golang.org/x/tools/go/packages"
+)
+
+// TestDepsImporterResolvesRealPackage loads a tiny module that imports the
+// standard library "fmt" package through the real packages.Load pipeline
+// CompileRegistry uses, then drives depsImporter.Import("fmt") the same way
+// the specializer's own checker would. depsImporter used to hand back
+// *go/types.Package reinterpreted as ply's forked *types.Package via a bare
+// pointer conversion between two independently maintained struct
+// definitions; this checks that resolving a real dependency instead
+// produces a *types.Package whose scope and method-set lookups actually
+// work, not just one that compiles.
+func TestDepsImporterResolvesRealPackage(t *testing.T) {
+	dir := t.TempDir()
+	const src = `package main
+
+import "fmt"
+
+func useFmt() fmt.Stringer { return nil }
+`
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/depsimportertest\n\ngo 1.18\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pkgs, err := packages.Load(&packages.Config{Dir: dir, Mode: loadMode}, ".")
+	if err != nil {
+		t.Fatalf("packages.Load: %v", err)
+	}
+	if len(pkgs) != 1 {
+		t.Fatalf("packages.Load returned %d packages, want 1", len(pkgs))
+	}
+	if errs := loadErrors(pkgs); len(errs) != 0 {
+		t.Fatalf("packages.Load errors: %v", errs)
+	}
+
+	imp := newDepsImporter(pkgs[0])
+	fmtPkg, err := imp.Import("fmt")
+	if err != nil {
+		t.Fatalf(`Import("fmt"): %v`, err)
+	}
+
+	obj := fmtPkg.Scope().Lookup("Stringer")
+	if obj == nil {
+		t.Fatal(`fmt package scope has no "Stringer"`)
+	}
+	named, ok := obj.Type().(*types.Named)
+	if !ok {
+		t.Fatalf("fmt.Stringer is a %T, want *types.Named", obj.Type())
+	}
+	set := types.NewMethodSet(named)
+	var hasString bool
+	for i := 0; i < set.Len(); i++ {
+		if set.At(i).Obj().Name() == "String" {
+			hasString = true
+		}
+	}
+	if !hasString {
+		t.Fatal("fmt.Stringer's method set has no String method")
+	}
+
+	// A second Import of the same path must reuse the cached *types.Package
+	// rather than re-running conf.Check, since depsImporter is also the
+	// Importer fed to every dependency's own Check call and a diamond in
+	// the import graph would otherwise redo the work once per importer.
+	again, err := imp.Import("fmt")
+	if err != nil {
+		t.Fatalf(`second Import("fmt"): %v`, err)
+	}
+	if again != fmtPkg {
+		t.Fatal("second Import(\"fmt\") did not return the cached *types.Package")
+	}
+}
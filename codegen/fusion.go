@@ -0,0 +1,165 @@
+package codegen
+
+import (
+	"go/ast"
+	"go/token"
+
+	"github.com/lukechampine/ply/types"
+)
+
+// isPlyCall reports whether call is a recognized ply generic method call --
+// e.g. `xs.filter(f)` -- as opposed to an ordinary method the receiver's
+// type already defines. It applies the test Rewrite uses to decide whether
+// a SelectorExpr callsite needs specializing, but against the built-in
+// methodGenerators only: a method generator added through a Registry is not
+// recognized here, so calls to it are not fused.
+func isPlyCall(call *ast.CallExpr, exprTypes map[ast.Expr]types.TypeAndValue) bool {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	_, ok = methodGenerators[sel.Sel.Name]
+	return ok && !hasMethod(sel.X, sel.Sel.Name, exprTypes)
+}
+
+// fusePipelines runs a package-wide pass that splices together ply method
+// calls separated by a single-use intermediate variable, so that
+//
+//	xs := nums.filter(f)
+//	ys := xs.map(g)
+//
+// is rewritten to
+//
+//	ys := nums.filter(f).map(g)
+//
+// with the xs declaration dropped, before the specializer ever walks the
+// file. Rewrite's existing chain-building in its SelectorExpr case then
+// fuses the result into a single specialization exactly as it already does
+// for a pipeline written as one expression.
+//
+// Fusion only considers a variable whose one use is the very next
+// statement after its declaration. That keeps the rewrite safe: splicing
+// the producer's call past an intervening statement would move its
+// evaluation later, reordering any side effect that statement has, and
+// there's no cheap, general way to prove an arbitrary statement has none.
+// It also sidesteps the scoping questions raised by reaching into a nested
+// block or another function's body.
+func fusePipelines(files []*ast.File, info *types.Info) {
+	uses := make(map[types.Object]int)
+	for _, f := range files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok {
+				if obj := info.Uses[id]; obj != nil {
+					uses[obj]++
+				}
+			}
+			return true
+		})
+	}
+
+	for _, f := range files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			if block, ok := n.(*ast.BlockStmt); ok {
+				fuseBlock(block, info, uses)
+			}
+			return true
+		})
+	}
+}
+
+// fuseBlock mutates block in place, splicing out every producer/consumer
+// pair it can find.
+func fuseBlock(block *ast.BlockStmt, info *types.Info, uses map[types.Object]int) {
+	for i := 0; i < len(block.List); i++ {
+		prod, ok := block.List[i].(*ast.AssignStmt)
+		if !ok || prod.Tok != token.DEFINE || len(prod.Lhs) != 1 || len(prod.Rhs) != 1 {
+			continue
+		}
+		call, ok := prod.Rhs[0].(*ast.CallExpr)
+		if !ok || !isPlyCall(call, info.Types) {
+			continue
+		}
+		lhs, ok := prod.Lhs[0].(*ast.Ident)
+		if !ok {
+			continue
+		}
+		obj := info.Defs[lhs]
+		if obj == nil || uses[obj] != 1 {
+			continue
+		}
+		// Only the immediately following statement is eligible: anything
+		// in between could have a side effect that splicing past would
+		// reorder.
+		if i+1 >= len(block.List) {
+			continue
+		}
+		consumer := findConsumer(block.List[i+1], obj, info)
+		if consumer == nil {
+			continue
+		}
+
+		// Splice the producer call into the consumer's receiver position,
+		// then drop the now-dead producer statement.
+		consumer.X = call
+		block.List = append(block.List[:i], block.List[i+1:]...)
+		i--
+	}
+}
+
+// findConsumer returns the ply-call SelectorExpr whose receiver resolves to
+// obj, if stmt's entire top-level expression is a chain of ply calls
+// (xs.filter(f).map(g)...) leading down to it. It only looks at that one
+// designated expression -- not anywhere a matching receiver might appear in
+// stmt -- so a receiver nested under an if/for/switch/select or FuncLit
+// body is never found (splicing there would make the producer's call
+// conditional, repeated, or deferred instead of the unconditional,
+// once-only evaluation its original position had), and neither is one
+// that's merely another operand alongside unrelated side-effecting
+// expressions in the same statement (splicing there would still evaluate
+// the producer in the same position, but change its evaluation order
+// relative to those other operands).
+func findConsumer(stmt ast.Stmt, obj types.Object, info *types.Info) *ast.SelectorExpr {
+	var expr ast.Expr
+	switch s := stmt.(type) {
+	case *ast.ExprStmt:
+		expr = s.X
+	case *ast.AssignStmt:
+		if len(s.Rhs) != 1 || len(s.Lhs) != 1 {
+			return nil
+		}
+		if _, ok := s.Lhs[0].(*ast.Ident); !ok {
+			// A non-ident LHS (e.g. a[g()] = ...) can itself evaluate an
+			// expression with a side effect. Go evaluates the LHS before the
+			// RHS, so splicing the producer's call into the RHS here would
+			// move it after that side effect, reordering it relative to its
+			// original position ahead of the whole statement.
+			return nil
+		}
+		expr = s.Rhs[0]
+	case *ast.ReturnStmt:
+		if len(s.Results) != 1 {
+			return nil
+		}
+		expr = s.Results[0]
+	default:
+		return nil
+	}
+	return consumerInChain(expr, obj, info)
+}
+
+// consumerInChain descends expr's ply-call chain looking for the call
+// whose receiver resolves to obj. The enclosing call must itself be a ply
+// call: an ordinary method or field access on the producer's result
+// (xs.Len(), xs.Field) is left alone rather than spliced into and silently
+// made incorrect.
+func consumerInChain(expr ast.Expr, obj types.Object, info *types.Info) *ast.SelectorExpr {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok || !isPlyCall(call, info.Types) {
+		return nil
+	}
+	sel := call.Fun.(*ast.SelectorExpr)
+	if id, ok := sel.X.(*ast.Ident); ok && info.Uses[id] == obj {
+		return sel
+	}
+	return consumerInChain(sel.X, obj, info)
+}
@@ -0,0 +1,136 @@
+package codegen
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+
+	"github.com/lukechampine/ply/types"
+)
+
+// withStubMethodGenerators temporarily replaces the built-in
+// methodGenerators map with stand-ins for "filter" and "xform", so fusion
+// tests exercise isPlyCall/findConsumer without depending on the real
+// generators (defined elsewhere, not part of this package's test build).
+// The second stand-in is named "xform" rather than the real generator's
+// "map": fixture source below is parsed by go/parser, which rejects "map"
+// after a dot outright -- it's a keyword, not an identifier token -- so
+// a literal ".map(...)" call can never appear in parsed Go source here
+// regardless of what fusePipelines does with it.
+func withStubMethodGenerators(t *testing.T) {
+	t.Helper()
+	stub := func(fn *ast.SelectorExpr, args []ast.Expr, exprTypes map[ast.Expr]types.TypeAndValue) (string, string, func(*ast.CallExpr) ast.Node) {
+		return "", "", nil
+	}
+	orig := methodGenerators
+	methodGenerators = map[string]MethodGenerator{"filter": stub, "xform": stub}
+	t.Cleanup(func() { methodGenerators = orig })
+}
+
+func checkFusionSource(t *testing.T, src string) (*ast.File, *types.Info) {
+	t.Helper()
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "test.ply.go", src, 0)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	info := &types.Info{
+		Types: make(map[ast.Expr]types.TypeAndValue),
+		Defs:  make(map[*ast.Ident]types.Object),
+		Uses:  make(map[*ast.Ident]types.Object),
+	}
+	var conf types.Config
+	if _, err := conf.Check("test", fset, []*ast.File{f}, info); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	return f, info
+}
+
+func funcBody(f *ast.File) *ast.BlockStmt {
+	for _, d := range f.Decls {
+		if fd, ok := d.(*ast.FuncDecl); ok && fd.Body != nil {
+			return fd.Body
+		}
+	}
+	return nil
+}
+
+func TestFusePipelines(t *testing.T) {
+	withStubMethodGenerators(t)
+
+	tests := []struct {
+		name      string
+		src       string
+		wantStmts int
+	}{
+		{
+			name: "adjacent single-use fuses",
+			src: `package p
+func f(nums []int, pred func(int) bool, fn func(int) int) []int {
+	xs := nums.filter(pred)
+	ys := xs.xform(fn)
+	return ys
+}`,
+			wantStmts: 2,
+		},
+		{
+			name: "intervening statement blocks fusion",
+			src: `package p
+func side()
+func f(nums []int, pred func(int) bool, fn func(int) int) []int {
+	xs := nums.filter(pred)
+	side()
+	ys := xs.xform(fn)
+	return ys
+}`,
+			wantStmts: 4,
+		},
+		{
+			name: "use inside if body blocks fusion",
+			src: `package p
+func f(nums []int, pred func(int) bool, fn func(int) int, cond bool) []int {
+	xs := nums.filter(pred)
+	var ys []int
+	if cond {
+		ys = xs.xform(fn)
+	}
+	return ys
+}`,
+			wantStmts: 4,
+		},
+		{
+			name: "non-ply consumer blocks fusion",
+			src: `package p
+func f(nums []int, pred func(int) bool) int {
+	xs := nums.filter(pred)
+	return len(xs)
+}`,
+			wantStmts: 2,
+		},
+		{
+			name: "side-effecting assignment LHS blocks fusion",
+			src: `package p
+func g() int
+func f(m map[int][]int, nums []int, pred func(int) bool, fn func(int) int) {
+	xs := nums.filter(pred)
+	m[g()] = xs.xform(fn)
+}`,
+			wantStmts: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, info := checkFusionSource(t, tt.src)
+			block := funcBody(f)
+			if block == nil {
+				t.Fatal("no function body found")
+			}
+			fusePipelines([]*ast.File{f}, info)
+			if got := len(block.List); got != tt.wantStmts {
+				t.Errorf("got %d statements after fusion, want %d", got, tt.wantStmts)
+			}
+		})
+	}
+}
@@ -0,0 +1,372 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"strings"
+
+	"github.com/lukechampine/ply/types"
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// Generator produces a specialized implementation for an ident-style ply
+// generic function call, e.g. `max(xs)`: the name of the generated
+// declaration, its Go source, and a rewrite from the original callsite to a
+// call of that declaration. A Generator that cannot specialize a given
+// callsite (for instance, one whose type parameters can't be inferred from
+// the arguments) reports that by returning an empty name; Rewrite then
+// leaves the callsite as written rather than using the other two results.
+type Generator func(fn *ast.Ident, args []ast.Expr, exprTypes map[ast.Expr]types.TypeAndValue) (name, code string, rewrite func(*ast.CallExpr) ast.Node)
+
+// MethodGenerator is a Generator for a ply generic method call, e.g.
+// `xs.filter(f)`.
+type MethodGenerator func(fn *ast.SelectorExpr, args []ast.Expr, exprTypes map[ast.Expr]types.TypeAndValue) (name, code string, rewrite func(*ast.CallExpr) ast.Node)
+
+// Registry holds generators consulted before the built-in
+// funcGenerators/methodGenerators set, so a caller can add their own
+// generic functions and methods without forking ply.
+type Registry struct {
+	funcs   map[string]Generator
+	methods map[string]MethodGenerator
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		funcs:   make(map[string]Generator),
+		methods: make(map[string]MethodGenerator),
+	}
+}
+
+// Register adds gen as the Generator for ident-style calls to name,
+// shadowing any built-in generator of the same name.
+func (r *Registry) Register(name string, gen Generator) {
+	r.funcs[name] = gen
+}
+
+// RegisterMethod adds gen as the MethodGenerator for method calls to name,
+// shadowing any built-in generator of the same name.
+func (r *Registry) RegisterMethod(name string, gen MethodGenerator) {
+	r.methods[name] = gen
+}
+
+// genericDirective marks a FuncDecl as a template for ply's own generic
+// dispatch, e.g.:
+//
+//	//ply:generic
+//	func Sum[T Number](xs []T) T { ... }
+const genericDirective = "//ply:generic"
+
+// mergeUserGenerics scans files for FuncDecls carrying a //ply:generic
+// directive, synthesizes a Generator for each, and returns a Registry
+// combining them with reg. reg's entries, if any, take precedence, so a
+// caller can still override a directive-declared function by registering
+// one under the same name. reg may be nil. localPkg is the package being
+// specialized, passed through to each generated template so a concrete
+// type it declares is emitted as a bare identifier rather than a
+// self-qualified, self-imported reference.
+func mergeUserGenerics(reg *Registry, files []*ast.File, localPkg *types.Package) (*Registry, error) {
+	merged := NewRegistry()
+	for _, f := range files {
+		for _, decl := range f.Decls {
+			fd, ok := decl.(*ast.FuncDecl)
+			if !ok || fd.Recv != nil || !hasDirective(fd.Doc, genericDirective) {
+				continue
+			}
+			tmpl, err := newFuncTemplate(fd, localPkg)
+			if err != nil {
+				return nil, fmt.Errorf("codegen: %s: %w", fd.Name.Name, err)
+			}
+			merged.Register(fd.Name.Name, tmpl.generate)
+		}
+	}
+	if reg != nil {
+		for name, gen := range reg.funcs {
+			merged.funcs[name] = gen
+		}
+		for name, gen := range reg.methods {
+			merged.methods[name] = gen
+		}
+	}
+	return merged, nil
+}
+
+// isGenericDecl reports whether decl is a //ply:generic template: a
+// directive-marked, receiver-less FuncDecl with a real Go type-parameter
+// list.
+func isGenericDecl(decl ast.Decl) bool {
+	fd, ok := decl.(*ast.FuncDecl)
+	return ok && fd.Recv == nil && hasDirective(fd.Doc, genericDirective) && fd.Type.TypeParams != nil
+}
+
+// stripGenericFuncs returns a copy of files with every //ply:generic
+// FuncDecl removed, for use with ply's own pre-generics Config.Check: that
+// checker predates Go's type-parameter syntax and has no notion of
+// FuncType.TypeParams, so handing it a real type-parameter list would mean
+// checking it the same way as an ordinary func -- producing bogus errors
+// about the type parameter names being undefined, at best. A template's
+// body never needs to be checked by ply's checker in the first place: it's
+// monomorphized straight from the concrete types at each callsite (see
+// mergeUserGenerics/funcTemplate), not type-checked as written. A file with
+// no such decl is returned unchanged, so this only allocates for the
+// (expected to be rare) files that declare one.
+func stripGenericFuncs(files []*ast.File) []*ast.File {
+	out := make([]*ast.File, len(files))
+	for i, f := range files {
+		var has bool
+		for _, decl := range f.Decls {
+			if isGenericDecl(decl) {
+				has = true
+				break
+			}
+		}
+		if !has {
+			out[i] = f
+			continue
+		}
+		clone := *f
+		clone.Decls = make([]ast.Decl, 0, len(f.Decls))
+		for _, decl := range f.Decls {
+			if isGenericDecl(decl) {
+				continue
+			}
+			clone.Decls = append(clone.Decls, decl)
+		}
+		out[i] = &clone
+	}
+	return out
+}
+
+func hasDirective(doc *ast.CommentGroup, directive string) bool {
+	if doc == nil {
+		return false
+	}
+	for _, c := range doc.List {
+		if strings.HasPrefix(c.Text, directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// funcTemplate is a user-defined generic function, discovered via a
+// //ply:generic directive, that gets monomorphized per callsite the same
+// way the built-in generators are.
+type funcTemplate struct {
+	decl   *ast.FuncDecl
+	params []string // type parameter names, in declaration order
+
+	// pkg is the package the template's callsites live in, so a concrete
+	// type declared there is substituted as a bare identifier instead of a
+	// self-qualified, self-imported one; see typeExpr.
+	pkg *types.Package
+}
+
+// newFuncTemplate parses fd's type parameter list. Only the direct-value
+// (`x T`) and slice-of-type-param (`xs []T`) parameter shapes are
+// supported for inferring a type parameter's concrete type from a
+// callsite -- the shapes ply's own filter/map/reduce-style generators
+// already cover.
+func newFuncTemplate(fd *ast.FuncDecl, localPkg *types.Package) (*funcTemplate, error) {
+	if fd.Type.TypeParams == nil || len(fd.Type.TypeParams.List) == 0 {
+		return nil, fmt.Errorf("missing type parameter list")
+	}
+	var params []string
+	for _, field := range fd.Type.TypeParams.List {
+		for _, name := range field.Names {
+			params = append(params, name.Name)
+		}
+	}
+	return &funcTemplate{decl: fd, params: params, pkg: localPkg}, nil
+}
+
+// infer returns the concrete type for each of t.params, determined from the
+// types of the call's arguments.
+func (t *funcTemplate) infer(args []ast.Expr, exprTypes map[ast.Expr]types.TypeAndValue) (map[string]types.Type, error) {
+	concrete := make(map[string]types.Type, len(t.params))
+	i := 0
+	for _, field := range t.decl.Type.Params.List {
+		for range field.Names {
+			if i >= len(args) {
+				return nil, fmt.Errorf("too few arguments")
+			}
+			argType := exprTypes[args[i]].Type
+			switch typ := field.Type.(type) {
+			case *ast.Ident:
+				if isTypeParam(typ.Name, t.params) {
+					concrete[typ.Name] = argType
+				}
+			case *ast.ArrayType:
+				if elt, ok := typ.Elt.(*ast.Ident); ok && isTypeParam(elt.Name, t.params) {
+					if slice, ok := argType.(*types.Slice); ok {
+						concrete[elt.Name] = slice.Elem()
+					}
+				}
+			}
+			i++
+		}
+	}
+	for _, p := range t.params {
+		if concrete[p] == nil {
+			return nil, fmt.Errorf("could not infer type parameter %s", p)
+		}
+	}
+	return concrete, nil
+}
+
+func isTypeParam(name string, params []string) bool {
+	for _, p := range params {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// generate is a Generator: it monomorphizes t for a specific callsite by
+// substituting each type parameter with the concrete type inferred from
+// the call's arguments, and mangling the declaration's name to include
+// them (e.g. Sum[T] called on []int becomes Sum_int).
+//
+// If the type parameters can't be inferred for this callsite -- a type
+// parameter that's return-only, or a param shape infer doesn't cover, such
+// as map[K]V or a channel -- generate returns an empty name rather than
+// panicking, the same way a built-in generator signals "leave this call
+// alone" for an unsupported shape.
+func (t *funcTemplate) generate(fn *ast.Ident, args []ast.Expr, exprTypes map[ast.Expr]types.TypeAndValue) (name, code string, rewrite func(*ast.CallExpr) ast.Node) {
+	concrete, err := t.infer(args, exprTypes)
+	if err != nil {
+		return "", "", nil
+	}
+
+	mangled := t.decl.Name.Name
+	for _, p := range t.params {
+		mangled += "_" + sanitizeTypeName(concrete[p].String())
+	}
+
+	// Clone via a print/parse round trip rather than mutating t.decl's AST
+	// directly: t.decl is reused for every callsite, and its nodes are
+	// shared, so substituting in place would corrupt later
+	// instantiations with a different set of concrete types.
+	spec, err := cloneFuncDecl(t.decl, mangled)
+	if err != nil {
+		return "", "", nil
+	}
+	imports := substituteTypeParams(spec, concrete, t.pkg)
+
+	var buf bytes.Buffer
+	// Declared ahead of the func itself so a qualified concrete type (e.g.
+	// a third-party pkg.Foo) resolves: addDecl parses this code as its own
+	// file, and implBytes later merges every generated file's imports
+	// (deduped) into the output alongside the func bodies.
+	for path, localName := range imports {
+		fmt.Fprintf(&buf, "import %s %q\n", localName, path)
+	}
+	(&printer.Config{Tabwidth: 8, Mode: printer.RawFormat}).Fprint(&buf, token.NewFileSet(), spec)
+
+	return mangled, "\n" + buf.String() + "\n", func(call *ast.CallExpr) ast.Node {
+		return &ast.CallExpr{Fun: ast.NewIdent(mangled), Args: call.Args}
+	}
+}
+
+// cloneFuncDecl returns an independent copy of orig, renamed to newName
+// and stripped of its type parameter list, by printing and re-parsing it.
+func cloneFuncDecl(orig *ast.FuncDecl, newName string) (*ast.FuncDecl, error) {
+	var buf bytes.Buffer
+	if err := (&printer.Config{Tabwidth: 8}).Fprint(&buf, token.NewFileSet(), orig); err != nil {
+		return nil, err
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), "", "package p\n"+buf.String(), 0)
+	if err != nil {
+		return nil, err
+	}
+	clone := f.Decls[0].(*ast.FuncDecl)
+	clone.Name = ast.NewIdent(newName)
+	clone.Type.TypeParams = nil
+	return clone, nil
+}
+
+// substituteTypeParams rewrites every *ast.Ident in decl naming one of
+// concrete's keys into a real type expression for the concrete type, in
+// place, and returns the package imports (path -> local name) those
+// expressions need. localPkg is the package decl will be generated into;
+// see typeExpr.
+func substituteTypeParams(decl *ast.FuncDecl, concrete map[string]types.Type, localPkg *types.Package) map[string]string {
+	imports := make(map[string]string)
+	astutil.Apply(decl, func(c *astutil.Cursor) bool {
+		id, ok := c.Node().(*ast.Ident)
+		if !ok {
+			return true
+		}
+		t, ok := concrete[id.Name]
+		if !ok {
+			return true
+		}
+		expr, needs := typeExpr(t, localPkg)
+		for path, name := range needs {
+			imports[path] = name
+		}
+		c.Replace(expr)
+		return true
+	}, nil)
+	return imports
+}
+
+// typeExpr builds an AST type expression for t, along with any package
+// import (path -> local name) it requires. Unlike stuffing t.String() into
+// a single *ast.Ident -- which prints right for a plain type name but
+// leaves a qualified type's package (e.g. pkg.Foo) un-imported -- this
+// constructs the real node shape (*ast.StarExpr, *ast.ArrayType,
+// *ast.MapType, *ast.SelectorExpr, ...) so the result both prints and
+// compiles.
+//
+// localPkg is the package the resulting expression is generated into: a
+// *types.Named declared there is emitted as a bare identifier with no
+// import, the same way the built-in generators' types.Qualifier returns ""
+// for the local package, rather than a self-qualified reference requiring
+// a self-import -- both invalid in the package that declares the type.
+func typeExpr(t types.Type, localPkg *types.Package) (ast.Expr, map[string]string) {
+	switch t := t.(type) {
+	case *types.Named:
+		obj := t.Obj()
+		pkg := obj.Pkg()
+		if pkg == nil || pkg == localPkg {
+			return ast.NewIdent(obj.Name()), nil
+		}
+		return &ast.SelectorExpr{X: ast.NewIdent(pkg.Name()), Sel: ast.NewIdent(obj.Name())},
+			map[string]string{pkg.Path(): pkg.Name()}
+	case *types.Pointer:
+		elem, imports := typeExpr(t.Elem(), localPkg)
+		return &ast.StarExpr{X: elem}, imports
+	case *types.Slice:
+		elem, imports := typeExpr(t.Elem(), localPkg)
+		return &ast.ArrayType{Elt: elem}, imports
+	case *types.Array:
+		elem, imports := typeExpr(t.Elem(), localPkg)
+		return &ast.ArrayType{
+			Len: &ast.BasicLit{Kind: token.INT, Value: fmt.Sprintf("%d", t.Len())},
+			Elt: elem,
+		}, imports
+	case *types.Map:
+		key, keyImports := typeExpr(t.Key(), localPkg)
+		val, valImports := typeExpr(t.Elem(), localPkg)
+		imports := make(map[string]string, len(keyImports)+len(valImports))
+		for path, name := range keyImports {
+			imports[path] = name
+		}
+		for path, name := range valImports {
+			imports[path] = name
+		}
+		return &ast.MapType{Key: key, Value: val}, imports
+	default:
+		return ast.NewIdent(t.String()), nil
+	}
+}
+
+func sanitizeTypeName(s string) string {
+	return strings.NewReplacer("[]", "slice_", "*", "ptr_", ".", "_", " ", "_").Replace(s)
+}
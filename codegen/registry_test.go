@@ -0,0 +1,149 @@
+package codegen
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+
+	"github.com/lukechampine/ply/types"
+)
+
+func parseGenericFunc(t *testing.T, src string) *ast.FuncDecl {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), "test.go", "package p\n"+src, 0)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	return f.Decls[0].(*ast.FuncDecl)
+}
+
+// TestFuncTemplateGenerateUninferrable checks that generate reports an
+// uninferrable type parameter by returning an empty name rather than
+// panicking, for the param shapes infer doesn't cover.
+func TestFuncTemplateGenerateUninferrable(t *testing.T) {
+	mapArg := ast.NewIdent("m")
+	tests := []struct {
+		name      string
+		src       string
+		args      []ast.Expr
+		exprTypes map[ast.Expr]types.TypeAndValue
+	}{
+		{
+			name: "return-only type parameter",
+			src:  "func Zero[T any]() T { var z T; return z }",
+		},
+		{
+			name:      "map param shape",
+			src:       "func Keys[K comparable, V any](m map[K]V) []K { return nil }",
+			args:      []ast.Expr{mapArg},
+			exprTypes: map[ast.Expr]types.TypeAndValue{mapArg: {Type: types.NewMap(types.Typ[types.String], types.Typ[types.Int])}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd := parseGenericFunc(t, tt.src)
+			tmpl, err := newFuncTemplate(fd, nil)
+			if err != nil {
+				t.Fatalf("newFuncTemplate: %v", err)
+			}
+
+			name, code, rewrite := tmpl.generate(fd.Name, tt.args, tt.exprTypes)
+			if name != "" || code != "" || rewrite != nil {
+				t.Fatalf("generate() = (%q, %q, rewrite non-nil: %t), want empty name/code and nil rewrite", name, code, rewrite != nil)
+			}
+		})
+	}
+}
+
+// TestStripGenericFuncs checks that stripGenericFuncs removes only a
+// directive-marked FuncDecl with a real type-parameter list, leaving an
+// ordinary function, a method, and a directive-less generic-looking
+// FuncDecl (e.g. one ply forgot to annotate) untouched -- so ply's own
+// pre-generics Check never sees a type-parameter list it can't check, but
+// every other declaration in the file still reaches it.
+func TestStripGenericFuncs(t *testing.T) {
+	const src = `
+//ply:generic
+func Sum[T any](xs []T) T { var z T; return z }
+
+func Plain(x int) int { return x }
+
+func (r receiver) Method() int { return 0 }
+
+func Undirected[T any](x T) T { return x }
+`
+	f, err := parser.ParseFile(token.NewFileSet(), "test.go", "package p\n"+src, parser.ParseComments)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	stripped := stripGenericFuncs([]*ast.File{f})
+	if len(stripped) != 1 {
+		t.Fatalf("stripGenericFuncs returned %d files, want 1", len(stripped))
+	}
+	if len(f.Decls) != 4 {
+		t.Fatalf("original file mutated: got %d decls, want 4", len(f.Decls))
+	}
+
+	var names []string
+	for _, decl := range stripped[0].Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			t.Fatalf("unexpected decl %T", decl)
+		}
+		names = append(names, fd.Name.Name)
+	}
+	want := []string{"Plain", "Method", "Undirected"}
+	if len(names) != len(want) {
+		t.Fatalf("stripGenericFuncs kept %v, want %v", names, want)
+	}
+	for i, name := range want {
+		if names[i] != name {
+			t.Fatalf("stripGenericFuncs kept %v, want %v", names, want)
+		}
+	}
+}
+
+func TestTypeExpr(t *testing.T) {
+	local := types.NewPackage("example.com/local", "p")
+	other := types.NewPackage("example.com/other", "other")
+	named := types.NewNamed(types.NewTypeName(token.NoPos, other, "Foo", nil), types.Typ[types.Int], nil)
+	localNamed := types.NewNamed(types.NewTypeName(token.NoPos, local, "Celsius", nil), types.Typ[types.Float64], nil)
+
+	tests := []struct {
+		name        string
+		typ         types.Type
+		localPkg    *types.Package
+		wantPrinted string
+		wantImport  string
+	}{
+		{name: "basic", typ: types.Typ[types.Int], wantPrinted: "int"},
+		{name: "slice", typ: types.NewSlice(types.Typ[types.Int]), wantPrinted: "[]int"},
+		{name: "pointer", typ: types.NewPointer(types.Typ[types.Int]), wantPrinted: "*int"},
+		{name: "named with package", typ: named, wantPrinted: "other.Foo", wantImport: "example.com/other"},
+		{
+			name:        "named declared in the local package",
+			typ:         localNamed,
+			localPkg:    local,
+			wantPrinted: "Celsius",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expr, imports := typeExpr(tt.typ, tt.localPkg)
+			got := astToBytes(token.NewFileSet(), expr)
+			if string(got) != tt.wantPrinted {
+				t.Errorf("typeExpr(%v) printed %q, want %q", tt.typ, got, tt.wantPrinted)
+			}
+			if tt.wantImport != "" {
+				if _, ok := imports[tt.wantImport]; !ok {
+					t.Errorf("typeExpr(%v) imports = %v, want %q present", tt.typ, imports, tt.wantImport)
+				}
+			}
+			if tt.wantImport == "" && len(imports) != 0 {
+				t.Errorf("typeExpr(%v) imports = %v, want none", tt.typ, imports)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+// Command ply compiles .ply source files into ordinary Go, specializing
+// each pseudo-generic call site into a concrete implementation.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/lukechampine/ply/codegen"
+)
+
+var errorsFlag = flag.String("errors", "first", `how many type errors to report when compilation fails: "first" (default) or "all"`)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ply [-errors=all] file.ply...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *errorsFlag != "first" && *errorsFlag != "all" {
+		fmt.Fprintf(os.Stderr, "ply: -errors must be \"first\" or \"all\", got %q\n", *errorsFlag)
+		os.Exit(2)
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if !compileFiles(flag.Args()) {
+		os.Exit(1)
+	}
+}
+
+// compileFiles runs codegen.Compile over filenames and writes each result
+// next to its .ply source as a .go file. It reports whether compilation
+// fully succeeded. A *codegen.CompileError is reported per the -errors flag but
+// isn't otherwise treated differently from any other error: Compile still
+// returns a usable, if incomplete, result for the call sites that did
+// type-check, and those are written out the same as on a clean compile.
+func compileFiles(filenames []string) (ok bool) {
+	out, err := codegen.Compile(filenames)
+	ok = err == nil
+	if cerr, isCompileErr := err.(*codegen.CompileError); isCompileErr {
+		if *errorsFlag == "all" {
+			fmt.Fprintln(os.Stderr, cerr)
+		} else if len(cerr.Errors) > 0 {
+			fmt.Fprintln(os.Stderr, cerr.Errors[0])
+		}
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "ply: %v\n", err)
+	}
+
+	for name, code := range out {
+		dst := strings.TrimSuffix(name, filepath.Ext(name)) + ".go"
+		if werr := os.WriteFile(dst, code, 0644); werr != nil {
+			fmt.Fprintf(os.Stderr, "ply: %v\n", werr)
+			ok = false
+		}
+	}
+	return ok
+}